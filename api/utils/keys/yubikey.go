@@ -18,14 +18,22 @@ package keys
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"io"
 	"math/big"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-piv/piv-go/piv"
@@ -46,33 +54,149 @@ var (
 	pivSlotWithTouch = piv.SlotSignature
 )
 
+// PINPrompt is called to retrieve the PIV PIN when a private key's PIN policy requires
+// one to be supplied for a slot operation. tsh uses this to prompt the user on the terminal.
+type PINPrompt func() (string, error)
+
+// GetOrGenerateYubiKeyPrivateKeyOpts contains the options used by
+// GetOrGenerateYubiKeyPrivateKeyWithOpts to select or generate a YubiKey private key.
+type GetOrGenerateYubiKeyPrivateKeyOpts struct {
+	// TouchRequired selects the PIV slot and touch policy used when a new key must be
+	// generated:
+	//  - true  => slot 9c (hardware_key_touch), TouchPolicyCached
+	//  - false => slot 9a (hardware_key), TouchPolicyNever
+	TouchRequired bool
+	// PINPolicy is the PIV PIN policy to generate a new key with, and the policy used
+	// to decide whether/how often Sign should request the PIN. Defaults to
+	// PINPolicyNever, which preserves the historical touch-only behavior.
+	PINPolicy piv.PINPolicy
+	// PINPrompt is called to retrieve the PIN when PINPolicy is not PINPolicyNever.
+	// It is required in that case; GetOrGenerateYubiKeyPrivateKeyWithOpts returns an
+	// error if it is nil.
+	PINPrompt PINPrompt
+	// YubiKeyURI, if set, pins the device (by serial), slot, PIN/touch policy,
+	// management key and/or PIN to use, overriding the corresponding fields above.
+	// See ParseYubiKeyURI.
+	YubiKeyURI *YubiKeyURI
+	// Algorithm selects the PIV key algorithm to generate a new key with, e.g.
+	// piv.AlgorithmEC384, piv.AlgorithmRSA2048/3072/4096, or piv.AlgorithmEd25519
+	// on firmware that supports it. Defaults to piv.AlgorithmEC256 if unset.
+	Algorithm piv.Algorithm
+}
+
 // GetOrGenerateYubiKeyPrivateKey connects to a connected yubiKey and gets a private key
 // matching the given touch requirement. This private key will either be newly generated
 // or previously generated by a Teleport client and reused.
 func GetOrGenerateYubiKeyPrivateKey(touchRequired bool) (*PrivateKey, error) {
-	// Use the first yubiKey we find.
-	y, err := findYubiKey(0)
-	if err != nil {
-		return nil, trace.Wrap(err)
+	return GetOrGenerateYubiKeyPrivateKeyWithOpts(GetOrGenerateYubiKeyPrivateKeyOpts{
+		TouchRequired: touchRequired,
+		PINPolicy:     piv.PINPolicyNever,
+	})
+}
+
+// GetOrGenerateYubiKeyPrivateKeyWithOpts is like GetOrGenerateYubiKeyPrivateKey, but
+// allows the caller to require a PIN policy stronger than PINPolicyNever (PINPolicyOnce
+// or PINPolicyAlways), supplying a PINPrompt so the PIN can be requested interactively.
+func GetOrGenerateYubiKeyPrivateKeyWithOpts(opts GetOrGenerateYubiKeyPrivateKeyOpts) (*PrivateKey, error) {
+	if opts.PINPolicy == 0 {
+		opts.PINPolicy = piv.PINPolicyNever
+	}
+	if opts.PINPolicy != piv.PINPolicyNever && opts.PINPrompt == nil && (opts.YubiKeyURI == nil || opts.YubiKeyURI.PIN == "") {
+		return nil, trace.BadParameter("a PIN prompt is required when PIN policy is not PINPolicyNever")
 	}
 
 	// Get the correct PIV slot and Touch policy for the given touch requirement:
 	//  - Slot 9a = hardware_key
 	//  - Slot 9c = hardware_key_touch
+	var serialNumber uint32
 	pivSlot := piv.SlotAuthentication
 	touchPolicy := piv.TouchPolicyNever
-	if touchRequired {
+	if opts.TouchRequired {
 		pivSlot = piv.SlotSignature
 		touchPolicy = piv.TouchPolicyCached
 	}
+	pinPolicy := opts.PINPolicy
+	pinPrompt := opts.PINPrompt
+	managementKey := piv.DefaultManagementKey
+	algorithm := opts.Algorithm
+	if algorithm == 0 {
+		algorithm = piv.AlgorithmEC256
+	}
+
+	// A yubikey: URI overrides the device, slot and policies picked above so that
+	// multi-YubiKey users can direct traffic to a specific device deterministically.
+	if uri := opts.YubiKeyURI; uri != nil {
+		serialNumber = uri.SerialNumber
+		if uri.Slot != nil {
+			pivSlot = *uri.Slot
+		}
+		if uri.TouchPolicy != nil {
+			touchPolicy = *uri.TouchPolicy
+		}
+		if uri.PINPolicy != nil {
+			pinPolicy = *uri.PINPolicy
+		}
+		if uri.ManagementKey != nil {
+			copy(managementKey[:], uri.ManagementKey)
+		}
+		if uri.PIN != "" {
+			pin := uri.PIN
+			pinPrompt = func() (string, error) { return pin, nil }
+		}
+	}
+
+	y, err := findYubiKey(serialNumber)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	hasManagementKeyOverride := opts.YubiKeyURI != nil && opts.YubiKeyURI.ManagementKey != nil
 
 	// First, check if there is already a private key set up by a Teleport Client.
+	var cachedPIN string
 	priv, err := y.getPrivateKey(pivSlot)
 	if err != nil {
-		// Generate a new private key on the PIV slot.
-		if priv, err = y.generatePrivateKey(pivSlot, touchPolicy); err != nil {
+		// We're about to generate a new key and need a management key to do it. If one
+		// wasn't pinned explicitly by a yubikey: URI, see whether YubiKeySetup has
+		// stored a PIN-protected management key for this card and prefer it over the
+		// well-known DefaultManagementKey. This doesn't depend on the slot's own PIN
+		// policy: SetupYubiKey's management-key rotation is independent of whatever
+		// PIN policy a key generated afterwards happens to use, so PINPolicyNever
+		// slots need this recovery just as much as PINPolicyOnce/Always ones. We only
+		// probe when a PIN prompt is actually available, so callers that never wired
+		// one up aren't forced to add one just for this.
+		if !hasManagementKeyOverride && pinPrompt != nil {
+			resolved, pin, pinErr := y.pinProtectedManagementKey(pinPrompt)
+			cachedPIN = pin
+			if pinErr == nil {
+				managementKey = resolved
+			}
+		}
+
+		if priv, err = y.generatePrivateKey(pivSlot, touchPolicy, pinPolicy, pinPrompt, managementKey, algorithm); err != nil {
 			return nil, trace.Wrap(err)
 		}
+	} else if hasManagementKeyOverride {
+		// The slot already exists, but a yubikey: URI pinned a specific management
+		// key; honor it instead of the DefaultManagementKey getPrivateKey assumed.
+		priv.managementKey = managementKey
+	} else if pinPrompt != nil {
+		// The slot's management key may have been rotated by SetupYubiKey since this
+		// key was first generated; recover it now so StoreCertificate and other admin
+		// operations authenticate with it instead of the stale DefaultManagementKey.
+		// SetupYubiKey's rotation doesn't care what PIN policy this particular slot
+		// was generated with, so this recovery attempt doesn't either.
+		resolved, pin, pinErr := y.pinProtectedManagementKey(pinPrompt)
+		cachedPIN = pin
+		if pinErr == nil {
+			priv.managementKey = resolved
+		}
+	}
+
+	priv.pinPolicy = pinPolicy
+	priv.pinPrompt = pinPrompt
+	if cachedPIN != "" && pinPolicy == piv.PINPolicyOnce {
+		priv.cachedPIN = cachedPIN
 	}
 
 	keyPEM, err := priv.keyPEM()
@@ -83,6 +207,177 @@ func GetOrGenerateYubiKeyPrivateKey(touchRequired bool) (*PrivateKey, error) {
 	return NewPrivateKey(priv, keyPEM)
 }
 
+// YubiKeySetupOpts configures SetupYubiKey.
+type YubiKeySetupOpts struct {
+	// YubiKeyURI, if set, pins the device to set up by serial. If it also carries a
+	// management key, that key is trusted as the card's actual current management
+	// key instead of piv.DefaultManagementKey or the PIN-protected metadata value, for
+	// cards whose management key isn't either of those. See ParseYubiKeyURI.
+	YubiKeyURI *YubiKeyURI
+	// PINPrompt is called to retrieve the card's current PIN, which is used to read a
+	// management key previously stored PIN-protected on the card (falling back to
+	// piv.DefaultManagementKey when there is none) and, if NewPIN is set, to change it.
+	PINPrompt PINPrompt
+	// NewPIN, if set, replaces the card's PIN with this value once setup completes.
+	NewPIN string
+	// NewPUK, if set, replaces the card's PUK with this value once setup completes.
+	NewPUK string
+}
+
+// SetupYubiKey replaces a YubiKey's management key — piv.DefaultManagementKey, a
+// well-known 3DES key that lets anyone with physical access to the card overwrite
+// Teleport-provisioned slots — with a randomly generated one, and stores it
+// PIN-protected on the card's PIV Admin metadata object so that
+// GetOrGenerateYubiKeyPrivateKeyWithOpts can recover it later using only the user's
+// PIN. It also optionally rotates the PIN and/or PUK to user-supplied values.
+//
+// This is the "PIN-protected management key" pattern supported by modern YubiKey PIV
+// applets; a card that has never been through SetupYubiKey keeps using
+// piv.DefaultManagementKey until this is called.
+//
+// This is the entry point a `tsh piv setup` subcommand is expected to call, prompting
+// for the PIN (and, if the user opts in, a new PIN/PUK) on the terminal. tool/tsh
+// itself isn't part of this source tree, so that subcommand isn't added here.
+func SetupYubiKey(opts YubiKeySetupOpts) error {
+	if opts.PINPrompt == nil {
+		return trace.BadParameter("a PIN prompt is required to set up a YubiKey management key")
+	}
+
+	var serialNumber uint32
+	if opts.YubiKeyURI != nil {
+		serialNumber = opts.YubiKeyURI.SerialNumber
+	}
+
+	y, err := findYubiKey(serialNumber)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	yk, err := y.open()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer yk.Close()
+
+	pin, err := opts.PINPrompt()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	currentManagementKey := piv.DefaultManagementKey
+	if metadata, err := yk.Metadata(pin); err == nil && metadata.ManagementKey != nil {
+		currentManagementKey = *metadata.ManagementKey
+	}
+	if opts.YubiKeyURI != nil && opts.YubiKeyURI.ManagementKey != nil {
+		// The caller knows the card's actual current management key — e.g. it was set
+		// up outside of SetupYubiKey — so trust it over both the default and whatever
+		// the PIN-protected metadata object claims.
+		copy(currentManagementKey[:], opts.YubiKeyURI.ManagementKey)
+	}
+
+	newManagementKey, err := randomManagementKey()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := yk.SetManagementKey(currentManagementKey, newManagementKey); err != nil {
+		return trace.Wrap(err, "rotating YubiKey management key")
+	}
+
+	if err := yk.SetMetadata(newManagementKey, &piv.Metadata{ManagementKey: &newManagementKey}); err != nil {
+		// The card is now keyed with newManagementKey but nothing durable records
+		// it; roll back to currentManagementKey so the card isn't left locked with
+		// a management key that only existed in this process's memory.
+		if rollbackErr := yk.SetManagementKey(newManagementKey, currentManagementKey); rollbackErr != nil {
+			return trace.NewAggregate(
+				trace.Wrap(err, "storing PIN-protected YubiKey management key"),
+				trace.Wrap(rollbackErr, "rolling back YubiKey management key after failed metadata write"),
+			)
+		}
+		return trace.Wrap(err, "storing PIN-protected YubiKey management key")
+	}
+
+	if opts.NewPUK != "" {
+		if err := yk.SetPUK(piv.DefaultPUK, opts.NewPUK); err != nil {
+			return trace.Wrap(err, "rotating YubiKey PUK")
+		}
+	}
+
+	if opts.NewPIN != "" {
+		if err := yk.SetPIN(pin, opts.NewPIN); err != nil {
+			return trace.Wrap(err, "rotating YubiKey PIN")
+		}
+	}
+
+	return nil
+}
+
+// randomManagementKey generates a random 24-byte 3DES management key to replace
+// piv.DefaultManagementKey with, following the same approach as generating a private
+// key's serial number (see crypto/tls/generate_cert.go).
+func randomManagementKey() ([24]byte, error) {
+	var key [24]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return key, trace.Wrap(err)
+	}
+	return key, nil
+}
+
+// ResetYubiKeyPINOpts configures ResetYubiKeyPIN.
+type ResetYubiKeyPINOpts struct {
+	// YubiKeyURI, if set, pins the device to reset by serial. See ParseYubiKeyURI.
+	YubiKeyURI *YubiKeyURI
+	// PUKPrompt is called to retrieve the card's PUK.
+	PUKPrompt PINPrompt
+	// NewPIN is the PIN to set once the PUK unblocks the slot.
+	NewPIN string
+}
+
+// ResetYubiKeyPIN unblocks a YubiKey's PIV PIN using the PUK, for a user who has
+// locked their PIN after three incorrect attempts. Like the PIN, the PUK itself only
+// allows three incorrect attempts before the card's PIV applet is permanently locked
+// and must be reset entirely, so callers driving an interactive "forgot my PIN" UX
+// (e.g. `tsh piv reset`) should clearly warn the user before each retry.
+//
+// This is the entry point a `tsh piv reset` subcommand is expected to call, walking
+// the user through the 3-strike PUK retry budget on the terminal. tool/tsh itself
+// isn't part of this source tree, so that subcommand isn't added here.
+func ResetYubiKeyPIN(opts ResetYubiKeyPINOpts) error {
+	if opts.PUKPrompt == nil {
+		return trace.BadParameter("a PUK prompt is required to reset a YubiKey PIN")
+	}
+	if opts.NewPIN == "" {
+		return trace.BadParameter("a new PIN is required to reset a YubiKey PIN")
+	}
+
+	var serialNumber uint32
+	if opts.YubiKeyURI != nil {
+		serialNumber = opts.YubiKeyURI.SerialNumber
+	}
+
+	y, err := findYubiKey(serialNumber)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	yk, err := y.open()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer yk.Close()
+
+	puk, err := opts.PUKPrompt()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := yk.Unblock(puk, opts.NewPIN); err != nil {
+		return trace.Wrap(err, "unblocking YubiKey PIN with PUK")
+	}
+
+	return nil
+}
+
 // YubiKeyPrivateKey is a YubiKey PIV private key. Cryptographical operations open
 // a new temporary connection to the PIV card to perform the operation.
 type YubiKeyPrivateKey struct {
@@ -90,23 +385,59 @@ type YubiKeyPrivateKey struct {
 	*yubiKey
 	pivSlot piv.Slot
 	pub     crypto.PublicKey
+	// algorithm is the PIV key algorithm this key was generated with, e.g.
+	// piv.AlgorithmEC256, piv.AlgorithmRSA2048, or piv.AlgorithmEd25519.
+	algorithm piv.Algorithm
+	// managementKey authorizes admin slot operations (SetCertificate) for
+	// StoreCertificate. Defaults to piv.DefaultManagementKey.
+	managementKey [24]byte
+
+	// pinPolicy is the PIV PIN policy this key was generated with. It determines
+	// whether and how often Sign must supply a PIN to the slot.
+	pinPolicy piv.PINPolicy
+	// pinPrompt retrieves the PIN from the user. It must be set whenever pinPolicy
+	// is not PINPolicyNever.
+	pinPrompt PINPrompt
+
+	// pinCacheMu guards cachedPIN.
+	pinCacheMu sync.Mutex
+	// cachedPIN holds the PIN for the lifetime of the process when pinPolicy is
+	// PINPolicyOnce, so the user is only prompted once per `tsh` invocation.
+	cachedPIN string
 }
 
 // yubiKeyPrivateKeyData is marshalable data used to retrieve a specific yubiKey PIV private key.
 type yubiKeyPrivateKeyData struct {
 	SerialNumber uint32 `json:"serial_number"`
 	SlotKey      uint32 `json:"slot_key"`
+	// PINPolicy is the piv.PINPolicy the key was generated with, persisted so that
+	// parseYubiKeyPrivateKeyData can rehydrate the same PIN requirements on reuse.
+	PINPolicy uint32 `json:"pin_policy,omitempty"`
+	// Algorithm is the piv.Algorithm the key was generated with, persisted so that
+	// parseYubiKeyPrivateKeyData can validate the slot still holds the expected
+	// key type on reuse.
+	Algorithm uint32 `json:"algorithm,omitempty"`
 }
 
 func newYubiKeyPrivateKey(y *yubiKey, slot piv.Slot, pub crypto.PublicKey) (*YubiKeyPrivateKey, error) {
 	return &YubiKeyPrivateKey{
-		yubiKey: y,
-		pivSlot: slot,
-		pub:     pub,
+		yubiKey:       y,
+		pivSlot:       slot,
+		pub:           pub,
+		algorithm:     algorithmForPublicKey(pub),
+		managementKey: piv.DefaultManagementKey,
+		pinPolicy:     piv.PINPolicyNever,
 	}, nil
 }
 
-func parseYubiKeyPrivateKeyData(keyDataBytes []byte) (*YubiKeyPrivateKey, error) {
+// parseYubiKeyPrivateKeyData rehydrates a YubiKeyPrivateKey from its persisted
+// representation. uri is optional and, when provided, supplies material that is
+// never persisted to disk: the management key and/or PIN needed to use the slot,
+// and may pin the lookup to a specific device by serial. Unless uri supplies a literal
+// PIN, pinPrompt is used to interactively retrieve the PIN: once here to recover a
+// PIN-protected management key stored by SetupYubiKey (unless uri supplies a management
+// key), whatever the key's PINPolicy, and later by Sign when the PINPolicy requires one.
+func parseYubiKeyPrivateKeyData(keyDataBytes []byte, uri *YubiKeyURI, pinPrompt PINPrompt) (*YubiKeyPrivateKey, error) {
 	var keyData yubiKeyPrivateKeyData
 	if err := json.Unmarshal(keyDataBytes, &keyData); err != nil {
 		return nil, trace.Wrap(err)
@@ -117,7 +448,31 @@ func parseYubiKeyPrivateKeyData(keyDataBytes []byte) (*YubiKeyPrivateKey, error)
 		return nil, trace.Wrap(err)
 	}
 
-	y, err := findYubiKey(keyData.SerialNumber)
+	pinPolicy, err := parsePINPolicy(keyData.PINPolicy)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	algorithm, err := parseAlgorithm(keyData.Algorithm)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	serialNumber := keyData.SerialNumber
+	if uri != nil {
+		if uri.SerialNumber != 0 {
+			serialNumber = uri.SerialNumber
+		}
+		if uri.PINPolicy != nil {
+			pinPolicy = *uri.PINPolicy
+		}
+		if uri.PIN != "" {
+			pin := uri.PIN
+			pinPrompt = func() (string, error) { return pin, nil }
+		}
+	}
+
+	y, err := findYubiKey(serialNumber)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -127,6 +482,35 @@ func parseYubiKeyPrivateKeyData(keyDataBytes []byte) (*YubiKeyPrivateKey, error)
 		return nil, trace.Wrap(err)
 	}
 
+	var cachedPIN string
+	switch {
+	case uri != nil && uri.ManagementKey != nil:
+		copy(priv.managementKey[:], uri.ManagementKey)
+	case pinPrompt != nil:
+		// The slot's management key may have been rotated by SetupYubiKey since this
+		// key was first generated; recover it now so StoreCertificate and other admin
+		// operations authenticate with it instead of the stale DefaultManagementKey.
+		// SetupYubiKey's rotation doesn't care what PIN policy this slot was
+		// generated with, so this recovery attempt doesn't either.
+		resolved, pin, err := y.pinProtectedManagementKey(pinPrompt)
+		cachedPIN = pin
+		if err == nil {
+			priv.managementKey = resolved
+		}
+	}
+
+	if priv.algorithm != algorithm {
+		return nil, trace.BadParameter("YubiKey slot %X holds a key generated with a different algorithm than expected; the slot may have been regenerated", pivSlot.Key)
+	}
+
+	priv.pinPolicy = pinPolicy
+	if pinPrompt != nil {
+		priv.pinPrompt = pinPrompt
+	}
+	if cachedPIN != "" && pinPolicy == piv.PINPolicyOnce {
+		priv.cachedPIN = cachedPIN
+	}
+
 	return priv, nil
 }
 
@@ -143,7 +527,14 @@ func (y *YubiKeyPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.Sign
 	}
 	defer yk.Close()
 
-	privateKey, err := yk.PrivateKey(y.pivSlot, y.pub, piv.KeyAuth{})
+	auth := piv.KeyAuth{PINPolicy: y.pinPolicy}
+	if y.pinPolicy != piv.PINPolicyNever {
+		if auth.PIN, err = y.pin(yk); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+
+	privateKey, err := yk.PrivateKey(y.pivSlot, y.pub, auth)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -151,10 +542,66 @@ func (y *YubiKeyPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.Sign
 	return privateKey.(crypto.Signer).Sign(rand, digest, opts)
 }
 
+// pin returns the PIN to use for a slot operation, prompting the user and caching the
+// result when the PIN policy is PINPolicyOnce.
+//
+// YubiKeys older than firmware 4.3.0 cannot reliably report whether a PIN is already
+// cached on the card, so on those devices we always re-prompt instead of trusting our
+// in-process cache.
+func (y *YubiKeyPrivateKey) pin(yk *piv.YubiKey) (string, error) {
+	if y.pinPrompt == nil {
+		return "", trace.BadParameter("private key slot %X requires a PIN but no PIN prompt was provided", y.pivSlot.Key)
+	}
+
+	canCachePIN := y.pinPolicy == piv.PINPolicyOnce && yubiKeySupportsPINCaching(yk)
+	if canCachePIN {
+		y.pinCacheMu.Lock()
+		defer y.pinCacheMu.Unlock()
+		if y.cachedPIN != "" {
+			return y.cachedPIN, nil
+		}
+	}
+
+	pin, err := y.pinPrompt()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	if canCachePIN {
+		y.cachedPIN = pin
+	}
+
+	return pin, nil
+}
+
+// yubiKeyPINCachingMinVersion is the first YubiKey firmware version that reliably
+// reports whether a PIN is already cached on the card.
+var yubiKeyPINCachingMinVersion = piv.Version{Major: 4, Minor: 3, Patch: 0}
+
+func yubiKeySupportsPINCaching(yk *piv.YubiKey) bool {
+	v, err := yk.Version()
+	if err != nil {
+		return false
+	}
+	return !pivVersionLess(v, yubiKeyPINCachingMinVersion)
+}
+
+func pivVersionLess(v, min piv.Version) bool {
+	if v.Major != min.Major {
+		return v.Major < min.Major
+	}
+	if v.Minor != min.Minor {
+		return v.Minor < min.Minor
+	}
+	return v.Patch < min.Patch
+}
+
 func (y *YubiKeyPrivateKey) keyPEM() ([]byte, error) {
 	keyDataBytes, err := json.Marshal(yubiKeyPrivateKeyData{
 		SerialNumber: y.serialNumber,
 		SlotKey:      y.pivSlot.Key,
+		PINPolicy:    uint32(y.pinPolicy),
+		Algorithm:    uint32(y.algorithm),
 	})
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -188,6 +635,92 @@ func (y *YubiKeyPrivateKey) GetAttestationCerts() (slotCert, attestationCert *x5
 	return slotCert, attestationCert, nil
 }
 
+// StoreCertificate writes cert to this key's PIV slot, replacing whatever certificate is
+// currently stored there (including the self-signed Teleport Client marker certificate
+// created by generatePrivateKey). This lets a YubiKey double as a portable store for a
+// Teleport-issued user or SSH-CA-signed X.509 certificate, so that other tools (browsers,
+// PKCS#11 bridges) can read it directly from the card.
+func (y *YubiKeyPrivateKey) StoreCertificate(cert *x509.Certificate) error {
+	yk, err := y.open()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer yk.Close()
+
+	if err := yk.SetCertificate(y.managementKey, y.pivSlot, cert); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// LoadCertificate reads the X.509 certificate currently stored in this key's PIV slot,
+// e.g. a certificate previously written with StoreCertificate.
+func (y *YubiKeyPrivateKey) LoadCertificate() (*x509.Certificate, error) {
+	yk, err := y.open()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer yk.Close()
+
+	cert, err := yk.Certificate(y.pivSlot)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return cert, nil
+}
+
+// PIVAttestation holds the device identity and slot policies extracted from a YubiKey
+// PIV slot's attestation certificate, once it has been verified against the device's
+// attestation certificate.
+type PIVAttestation struct {
+	// Serial is the YubiKey's 8 digit serial number.
+	Serial uint32
+	// Formfactor is the attested form factor of the YubiKey, e.g. piv.FormfactorUSBAKeychain.
+	Formfactor piv.Formfactor
+	// Version is the attested firmware version of the YubiKey.
+	Version piv.Version
+	// PINPolicy is the PIN policy the slot was generated with, as attested by the device.
+	PINPolicy piv.PINPolicy
+	// TouchPolicy is the touch policy the slot was generated with, as attested by the device.
+	TouchPolicy piv.TouchPolicy
+}
+
+// Attestation verifies this key's slot certificate against the device's attestation
+// certificate and extracts the device's serial number (attestation extension OID
+// 1.3.6.1.4.1.41482.3.7), formfactor and firmware version, and slot key policies
+// (OIDs .3.8 and .3.9). Callers can use this to enforce hardware-key policy (e.g.
+// "must have touch cached") at enrollment time.
+func (y *YubiKeyPrivateKey) Attestation() (*PIVAttestation, error) {
+	slotCert, attestationCert, err := y.GetAttestationCerts()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	attestation, err := piv.Verify(attestationCert, slotCert)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &PIVAttestation{
+		Serial:      attestation.Serial,
+		Formfactor:  attestation.Formfactor,
+		Version:     attestation.Version,
+		PINPolicy:   attestation.PINPolicy,
+		TouchPolicy: attestation.TouchPolicy,
+	}, nil
+}
+
+// PermanentIdentifier returns this key's attested YubiKey serial number as a decimal
+// string, suitable for use as an ACME "permanent-identifier" SAN value or as a
+// device-trust binding key on the Teleport auth server.
+func (y *YubiKeyPrivateKey) PermanentIdentifier() (string, error) {
+	attestation, err := y.Attestation()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return strconv.FormatUint(uint64(attestation.Serial), 10), nil
+}
+
 // yubiKey is a specific yubiKey PIV card.
 type yubiKey struct {
 	// card is a reader name used to find and connect to this yubiKey.
@@ -215,7 +748,9 @@ func newYubiKey(card string) (*yubiKey, error) {
 }
 
 // generatePrivateKey generates a new private key from the given PIV slot with the given PIV policies.
-func (y *yubiKey) generatePrivateKey(slot piv.Slot, touchPolicy piv.TouchPolicy) (*YubiKeyPrivateKey, error) {
+// pinPrompt supplies the PIN needed to sign the marker certificate when pinPolicy is
+// not PINPolicyNever.
+func (y *yubiKey) generatePrivateKey(slot piv.Slot, touchPolicy piv.TouchPolicy, pinPolicy piv.PINPolicy, pinPrompt PINPrompt, managementKey [24]byte, algorithm piv.Algorithm) (*YubiKeyPrivateKey, error) {
 	yk, err := y.open()
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -223,18 +758,18 @@ func (y *yubiKey) generatePrivateKey(slot piv.Slot, touchPolicy piv.TouchPolicy)
 	defer yk.Close()
 
 	opts := piv.Key{
-		Algorithm:   piv.AlgorithmEC256,
-		PINPolicy:   piv.PINPolicyNever,
+		Algorithm:   algorithm,
+		PINPolicy:   pinPolicy,
 		TouchPolicy: touchPolicy,
 	}
-	pub, err := yk.GenerateKey(piv.DefaultManagementKey, slot, opts)
+	pub, err := yk.GenerateKey(managementKey, slot, opts)
 	if err != nil {
-		return nil, trace.Wrap(err)
+		return nil, trace.Wrap(err, "generating a %v key in YubiKey slot %X", algorithm, slot.Key)
 	}
 
 	// Create a self signed certificate and store it in the PIV slot so that other
 	// Teleport Clients know to reuse the stored key instead of genearting a new one.
-	priv, err := yk.PrivateKey(slot, pub, piv.KeyAuth{})
+	priv, err := yk.PrivateKey(slot, pub, piv.KeyAuth{PINPolicy: pinPolicy, PINPrompt: pinPrompt})
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -245,11 +780,18 @@ func (y *yubiKey) generatePrivateKey(slot piv.Slot, touchPolicy piv.TouchPolicy)
 	}
 
 	// Store a self-signed certificate to mark this slot as used by tsh.
-	if err = yk.SetCertificate(piv.DefaultManagementKey, slot, cert); err != nil {
+	if err = yk.SetCertificate(managementKey, slot, cert); err != nil {
 		return nil, trace.Wrap(err)
 	}
 
-	return newYubiKeyPrivateKey(y, slot, pub)
+	key, err := newYubiKeyPrivateKey(y, slot, pub)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	key.algorithm = algorithm
+	key.managementKey = managementKey
+	key.pinPolicy = pinPolicy
+	return key, nil
 }
 
 // getPrivateKey gets an existing private key from the given PIV slot.
@@ -260,12 +802,13 @@ func (y *yubiKey) getPrivateKey(slot piv.Slot) (*YubiKeyPrivateKey, error) {
 	}
 	defer yk.Close()
 
-	// Check the slot's certificate to see if it contains a self signed Teleport Client cert.
+	// Check the slot's certificate to see if it contains either the self signed
+	// Teleport Client marker cert, or any cert (e.g. one stored by StoreCertificate)
+	// whose leaf public key matches the attested slot key — see isTeleportSlotCertificate
+	// for the trade-off this second case makes.
 	cert, err := yk.Certificate(slot)
 	if err != nil || cert == nil {
 		return nil, trace.NotFound("YubiKey certificate slot is empty, expected a Teleport Client cert")
-	} else if len(cert.Subject.Organization) == 0 || cert.Subject.Organization[0] != certOrgName {
-		return nil, trace.NotFound("YubiKey certificate slot contained unknown certificate:\n%+v", cert)
 	}
 
 	// Attest the key to make sure it hasn't been imported.
@@ -281,6 +824,10 @@ func (y *yubiKey) getPrivateKey(slot piv.Slot) (*YubiKeyPrivateKey, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	if !isTeleportSlotCertificate(cert, slotCert) {
+		return nil, trace.NotFound("YubiKey certificate slot contained unknown certificate:\n%+v", cert)
+	}
+
 	// Verify that the slot's certs have the same public key, otherwise the key
 	// may have been generated by a non-teleport client.
 	if pubComparer, ok := cert.PublicKey.(interface{ Equal(x crypto.PublicKey) bool }); !ok {
@@ -292,6 +839,37 @@ func (y *yubiKey) getPrivateKey(slot piv.Slot) (*YubiKeyPrivateKey, error) {
 	return newYubiKeyPrivateKey(y, slot, slotCert.PublicKey)
 }
 
+// pinProtectedManagementKey recovers the management key previously stored PIN-protected
+// on this card by SetupYubiKey, using the PIV Admin metadata object. It returns
+// NotFound if the card has no PIN-protected management key set up, so callers can fall
+// back to piv.DefaultManagementKey.
+//
+// It returns the PIN it obtained even when no PIN-protected management key is found
+// (i.e. alongside a NotFound error), so that callers who already had to prompt for a
+// PIN here can still cache it for later Sign calls instead of prompting again.
+func (y *yubiKey) pinProtectedManagementKey(pinPrompt PINPrompt) (managementKey [24]byte, pin string, err error) {
+	yk, err := y.open()
+	if err != nil {
+		return managementKey, "", trace.Wrap(err)
+	}
+	defer yk.Close()
+
+	pin, err = pinPrompt()
+	if err != nil {
+		return managementKey, "", trace.Wrap(err)
+	}
+
+	metadata, err := yk.Metadata(pin)
+	if err != nil {
+		return managementKey, pin, trace.Wrap(err)
+	}
+	if metadata.ManagementKey == nil {
+		return managementKey, pin, trace.NotFound("YubiKey has no PIN-protected management key configured")
+	}
+
+	return *metadata.ManagementKey, pin, nil
+}
+
 // open a connection to yubiKey PIV module. The returned connection should be closed once
 // it's been used. The yubiKey PIV module itself takes some additional time to handle closed
 // connections, so we use a retry loop to give the PIV module time to close prior connections.
@@ -380,9 +958,234 @@ func parsePIVSlot(slotKey uint32) (piv.Slot, error) {
 	}
 }
 
+// yubiKeyURIScheme is the URI scheme used to select a specific YubiKey device, slot,
+// PIN/touch policy, management key and/or PIN. See ParseYubiKeyURI.
+const yubiKeyURIScheme = "yubikey"
+
+// YubiKeyURI is a parsed "yubikey:" URI, e.g.
+//
+//	yubikey:serial=12345678?slot=9c&pin-policy=once&touch-policy=cached&management-key=<hex>&pin=<val>
+//
+// Fields are left as the zero value when not present in the URI, so callers can use
+// them to selectively override defaults.
+type YubiKeyURI struct {
+	// SerialNumber selects a specific YubiKey by serial number. Zero means "the
+	// first YubiKey found", matching the historical findYubiKey(0) behavior.
+	SerialNumber uint32
+	// Slot selects one of the four standard PIV slots, or one of the 20 retired
+	// key-management slots.
+	Slot *piv.Slot
+	// PINPolicy overrides the PIN policy used to generate or sign with the key.
+	PINPolicy *piv.PINPolicy
+	// TouchPolicy overrides the touch policy used to generate the key.
+	TouchPolicy *piv.TouchPolicy
+	// ManagementKey is a custom 24-byte PIV management key, in place of
+	// piv.DefaultManagementKey.
+	ManagementKey []byte
+	// PIN, if set, is used to satisfy PIN-protected slot operations without
+	// prompting the user.
+	PIN string
+}
+
+// ParseYubiKeyURI parses a "yubikey:" URI used to pin a specific YubiKey device,
+// slot, PIN/touch policy, management key and/or PIN, e.g.
+//
+//	yubikey:serial=12345678?slot=9c&pin-policy=once&touch-policy=cached&management-key=<hex>&pin=<val>
+//
+// This lets multi-YubiKey users direct tsh at a specific device rather than relying
+// on "the first YubiKey we find".
+//
+// This is the integration point for tsh config and CLI flags: tool/tsh is expected to
+// accept a "yubikey:" value from a --piv-uri flag or its YAML config equivalent and
+// pass it straight to this function to build the YubiKeyURI threaded through
+// GetOrGenerateYubiKeyPrivateKeyWithOpts. tool/tsh itself isn't part of this source
+// tree, so that flag/config plumbing isn't added here.
+func ParseYubiKeyURI(uri string) (*YubiKeyURI, error) {
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok || scheme != yubiKeyURIScheme {
+		return nil, trace.BadParameter("expected a %q URI, got %q", yubiKeyURIScheme+":", uri)
+	}
+
+	path, query, _ := strings.Cut(rest, "?")
+
+	params := url.Values{}
+	for _, kv := range strings.Split(path, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, trace.BadParameter("invalid yubikey URI parameter %q", kv)
+		}
+		params.Set(k, v)
+	}
+	if query != "" {
+		queryParams, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		for k, v := range queryParams {
+			params[k] = v
+		}
+	}
+
+	out := &YubiKeyURI{}
+
+	if serial := params.Get("serial"); serial != "" {
+		serialNumber, err := strconv.ParseUint(serial, 10, 32)
+		if err != nil {
+			return nil, trace.BadParameter("invalid yubikey URI serial number %q", serial)
+		}
+		out.SerialNumber = uint32(serialNumber)
+	}
+
+	if slot := params.Get("slot"); slot != "" {
+		slotKey, err := strconv.ParseUint(slot, 16, 32)
+		if err != nil {
+			return nil, trace.BadParameter("invalid yubikey URI slot %q", slot)
+		}
+		pivSlot, err := parsePIVSlot(uint32(slotKey))
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		out.Slot = &pivSlot
+	}
+
+	if pinPolicy := params.Get("pin-policy"); pinPolicy != "" {
+		p, err := parsePINPolicyName(pinPolicy)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		out.PINPolicy = &p
+	}
+
+	if touchPolicy := params.Get("touch-policy"); touchPolicy != "" {
+		t, err := parseTouchPolicyName(touchPolicy)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		out.TouchPolicy = &t
+	}
+
+	if managementKey := params.Get("management-key"); managementKey != "" {
+		keyBytes, err := hex.DecodeString(managementKey)
+		if err != nil {
+			return nil, trace.BadParameter("invalid yubikey URI management key: %v", err)
+		}
+		if len(keyBytes) != 24 {
+			return nil, trace.BadParameter("yubikey URI management key must be 24 bytes, got %d", len(keyBytes))
+		}
+		out.ManagementKey = keyBytes
+	}
+
+	out.PIN = params.Get("pin")
+
+	return out, nil
+}
+
+func parsePINPolicyName(name string) (piv.PINPolicy, error) {
+	switch name {
+	case "never":
+		return piv.PINPolicyNever, nil
+	case "once":
+		return piv.PINPolicyOnce, nil
+	case "always":
+		return piv.PINPolicyAlways, nil
+	default:
+		return 0, trace.BadParameter("unknown yubikey URI pin-policy %q", name)
+	}
+}
+
+func parseTouchPolicyName(name string) (piv.TouchPolicy, error) {
+	switch name {
+	case "never":
+		return piv.TouchPolicyNever, nil
+	case "always":
+		return piv.TouchPolicyAlways, nil
+	case "cached":
+		return piv.TouchPolicyCached, nil
+	default:
+		return 0, trace.BadParameter("unknown yubikey URI touch-policy %q", name)
+	}
+}
+
+func parsePINPolicy(pinPolicy uint32) (piv.PINPolicy, error) {
+	switch piv.PINPolicy(pinPolicy) {
+	case 0:
+		// Older persisted keys won't have a PIN policy recorded; default to
+		// PINPolicyNever to preserve their original touch-only behavior.
+		return piv.PINPolicyNever, nil
+	case piv.PINPolicyNever, piv.PINPolicyOnce, piv.PINPolicyAlways:
+		return piv.PINPolicy(pinPolicy), nil
+	default:
+		return 0, trace.BadParameter("PIN policy %d does not exist", pinPolicy)
+	}
+}
+
+func parseAlgorithm(algorithm uint32) (piv.Algorithm, error) {
+	switch piv.Algorithm(algorithm) {
+	case 0:
+		// Older persisted keys won't have an algorithm recorded; default to
+		// AlgorithmEC256, the only algorithm previously supported.
+		return piv.AlgorithmEC256, nil
+	case piv.AlgorithmEC256, piv.AlgorithmEC384, piv.AlgorithmRSA2048, piv.AlgorithmRSA3072, piv.AlgorithmRSA4096, piv.AlgorithmEd25519:
+		return piv.Algorithm(algorithm), nil
+	default:
+		return 0, trace.BadParameter("algorithm %d does not exist", algorithm)
+	}
+}
+
+// algorithmForPublicKey infers the piv.Algorithm used to generate pub, so that keys
+// retrieved from an existing slot (rather than freshly generated by us) can still be
+// persisted and validated correctly.
+func algorithmForPublicKey(pub crypto.PublicKey) piv.Algorithm {
+	switch p := pub.(type) {
+	case *ecdsa.PublicKey:
+		if p.Curve == elliptic.P384() {
+			return piv.AlgorithmEC384
+		}
+		return piv.AlgorithmEC256
+	case *rsa.PublicKey:
+		switch p.Size() * 8 {
+		case 3072:
+			return piv.AlgorithmRSA3072
+		case 4096:
+			return piv.AlgorithmRSA4096
+		default:
+			return piv.AlgorithmRSA2048
+		}
+	case ed25519.PublicKey:
+		return piv.AlgorithmEd25519
+	default:
+		return piv.AlgorithmEC256
+	}
+}
+
 // certOrgName is used to identify Teleport Client self-signed certificates stored in yubiKey PIV slots.
 const certOrgName = "teleport"
 
+// isTeleportSlotCertificate reports whether cert marks slot as belonging to a Teleport
+// Client, either because it is the self-signed marker certificate created by
+// generatePrivateKey, or because its public key matches the slot's attested public key.
+//
+// The public-key fallback doesn't verify that cert was actually issued by a Teleport
+// CA or written by StoreCertificate — it accepts any certificate for the attested key,
+// including one left behind by another PIV tool that happens to reuse the same
+// keypair. This is a deliberate trade-off to let StoreCertificate's CA-issued certs be
+// recognized without threading a CA trust store through getPrivateKey; callers that
+// need to fail closed on a foreign certificate must verify the issuer themselves.
+func isTeleportSlotCertificate(cert, slotCert *x509.Certificate) bool {
+	if len(cert.Subject.Organization) > 0 && cert.Subject.Organization[0] == certOrgName {
+		return true
+	}
+
+	pubComparer, ok := cert.PublicKey.(interface{ Equal(x crypto.PublicKey) bool })
+	if !ok {
+		return false
+	}
+	return pubComparer.Equal(slotCert.PublicKey)
+}
+
 func selfSignedTeleportClientCertificate(priv crypto.PrivateKey, pub crypto.PublicKey) (*x509.Certificate, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit) // see crypto/tls/generate_cert.go
@@ -396,9 +1199,25 @@ func selfSignedTeleportClientCertificate(priv crypto.PrivateKey, pub crypto.Publ
 			Organization:       []string{certOrgName},
 			OrganizationalUnit: []string{api.Version},
 		},
+		SignatureAlgorithm: certSignatureAlgorithm(pub),
 	}
 	if cert.Raw, err = x509.CreateCertificate(rand.Reader, cert, cert, pub, priv); err != nil {
 		return nil, trace.Wrap(err)
 	}
 	return cert, nil
 }
+
+// certSignatureAlgorithm picks an x509 signature algorithm compatible with pub, so the
+// self-signed marker certificate can be created for any key algorithm the PIV applet
+// supports, not just ECDSA.
+func certSignatureAlgorithm(pub crypto.PublicKey) x509.SignatureAlgorithm {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	default:
+		// ECDSA keys (P-256/P-384): let x509 pick the curve-matched algorithm.
+		return x509.UnknownSignatureAlgorithm
+	}
+}
@@ -0,0 +1,335 @@
+//go:build libpcsclite
+// +build libpcsclite
+
+/*
+Copyright 2022 Gravitational, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/go-piv/piv-go/piv"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseYubiKeyURI(t *testing.T) {
+	t.Parallel()
+
+	pinPolicyOnce := piv.PINPolicyOnce
+	touchPolicyCached := piv.TouchPolicyCached
+	retiredSlot, ok := piv.RetiredKeyManagementSlot(0x82)
+	require.True(t, ok)
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    *YubiKeyURI
+		wantErr string
+	}{
+		{
+			name: "serial only",
+			uri:  "yubikey:serial=12345678",
+			want: &YubiKeyURI{SerialNumber: 12345678},
+		},
+		{
+			name: "full uri",
+			uri:  "yubikey:serial=12345678?slot=9c&pin-policy=once&touch-policy=cached&management-key=" + "000102030405060708090a0b0c0d0e0f1011121314151617" + "&pin=1234",
+			want: &YubiKeyURI{
+				SerialNumber:  12345678,
+				Slot:          &piv.SlotSignature,
+				PINPolicy:     &pinPolicyOnce,
+				TouchPolicy:   &touchPolicyCached,
+				ManagementKey: []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17},
+				PIN:           "1234",
+			},
+		},
+		{
+			name: "retired slot",
+			uri:  "yubikey:slot=82",
+			want: &YubiKeyURI{Slot: &retiredSlot},
+		},
+		{
+			name:    "wrong scheme",
+			uri:     "otherscheme:serial=123",
+			wantErr: "expected a \"yubikey:\" URI",
+		},
+		{
+			name:    "no scheme separator",
+			uri:     "yubikey",
+			wantErr: "expected a \"yubikey:\" URI",
+		},
+		{
+			name:    "malformed param",
+			uri:     "yubikey:serial",
+			wantErr: "invalid yubikey URI parameter",
+		},
+		{
+			name:    "invalid serial",
+			uri:     "yubikey:serial=notanumber",
+			wantErr: "invalid yubikey URI serial number",
+		},
+		{
+			name:    "invalid slot",
+			uri:     "yubikey:slot=zz",
+			wantErr: "invalid yubikey URI slot",
+		},
+		{
+			name:    "unknown slot",
+			uri:     "yubikey:slot=ff",
+			wantErr: "does not exist",
+		},
+		{
+			name:    "unknown pin policy",
+			uri:     "yubikey:serial=1?pin-policy=sometimes",
+			wantErr: "unknown yubikey URI pin-policy",
+		},
+		{
+			name:    "unknown touch policy",
+			uri:     "yubikey:serial=1?touch-policy=sometimes",
+			wantErr: "unknown yubikey URI touch-policy",
+		},
+		{
+			name:    "management key not hex",
+			uri:     "yubikey:serial=1?management-key=zz",
+			wantErr: "invalid yubikey URI management key",
+		},
+		{
+			name:    "management key wrong length",
+			uri:     "yubikey:serial=1?management-key=aabbcc",
+			wantErr: "must be 24 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseYubiKeyURI(tt.uri)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParsePIVSlot(t *testing.T) {
+	t.Parallel()
+
+	retiredSlot, ok := piv.RetiredKeyManagementSlot(0x82)
+	require.True(t, ok)
+
+	tests := []struct {
+		name    string
+		slotKey uint32
+		want    piv.Slot
+		wantErr string
+	}{
+		{name: "authentication", slotKey: piv.SlotAuthentication.Key, want: piv.SlotAuthentication},
+		{name: "signature", slotKey: piv.SlotSignature.Key, want: piv.SlotSignature},
+		{name: "card authentication", slotKey: piv.SlotCardAuthentication.Key, want: piv.SlotCardAuthentication},
+		{name: "key management", slotKey: piv.SlotKeyManagement.Key, want: piv.SlotKeyManagement},
+		{name: "retired slot", slotKey: 0x82, want: retiredSlot},
+		{name: "unknown slot", slotKey: 0xff, wantErr: "does not exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePIVSlot(tt.slotKey)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParsePINPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		in      uint32
+		want    piv.PINPolicy
+		wantErr string
+	}{
+		{name: "legacy zero value defaults to never", in: 0, want: piv.PINPolicyNever},
+		{name: "never", in: uint32(piv.PINPolicyNever), want: piv.PINPolicyNever},
+		{name: "once", in: uint32(piv.PINPolicyOnce), want: piv.PINPolicyOnce},
+		{name: "always", in: uint32(piv.PINPolicyAlways), want: piv.PINPolicyAlways},
+		{name: "unknown", in: 99, wantErr: "does not exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePINPolicy(tt.in)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		in      uint32
+		want    piv.Algorithm
+		wantErr string
+	}{
+		{name: "legacy zero value defaults to EC256", in: 0, want: piv.AlgorithmEC256},
+		{name: "EC256", in: uint32(piv.AlgorithmEC256), want: piv.AlgorithmEC256},
+		{name: "EC384", in: uint32(piv.AlgorithmEC384), want: piv.AlgorithmEC384},
+		{name: "RSA2048", in: uint32(piv.AlgorithmRSA2048), want: piv.AlgorithmRSA2048},
+		{name: "RSA3072", in: uint32(piv.AlgorithmRSA3072), want: piv.AlgorithmRSA3072},
+		{name: "RSA4096", in: uint32(piv.AlgorithmRSA4096), want: piv.AlgorithmRSA4096},
+		{name: "Ed25519", in: uint32(piv.AlgorithmEd25519), want: piv.AlgorithmEd25519},
+		{name: "unknown", in: 99, wantErr: "does not exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAlgorithm(tt.in)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAlgorithmForPublicKey(t *testing.T) {
+	t.Parallel()
+
+	ec256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	rsa2048Key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsa4096Key, err := rsa.GenerateKey(rand.Reader, 4096)
+	require.NoError(t, err)
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		pub  crypto.PublicKey
+		want piv.Algorithm
+	}{
+		{name: "EC P256", pub: &ec256Key.PublicKey, want: piv.AlgorithmEC256},
+		{name: "EC P384", pub: &ec384Key.PublicKey, want: piv.AlgorithmEC384},
+		{name: "RSA 2048", pub: &rsa2048Key.PublicKey, want: piv.AlgorithmRSA2048},
+		{name: "RSA 4096", pub: &rsa4096Key.PublicKey, want: piv.AlgorithmRSA4096},
+		{name: "Ed25519", pub: ed25519Key, want: piv.AlgorithmEd25519},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, algorithmForPublicKey(tt.pub))
+		})
+	}
+}
+
+func TestPivVersionLess(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		v    piv.Version
+		min  piv.Version
+		want bool
+	}{
+		{name: "equal", v: piv.Version{Major: 4, Minor: 3, Patch: 0}, min: piv.Version{Major: 4, Minor: 3, Patch: 0}, want: false},
+		{name: "lower major", v: piv.Version{Major: 3, Minor: 9, Patch: 9}, min: piv.Version{Major: 4, Minor: 3, Patch: 0}, want: true},
+		{name: "higher major", v: piv.Version{Major: 5, Minor: 0, Patch: 0}, min: piv.Version{Major: 4, Minor: 3, Patch: 0}, want: false},
+		{name: "lower minor", v: piv.Version{Major: 4, Minor: 2, Patch: 9}, min: piv.Version{Major: 4, Minor: 3, Patch: 0}, want: true},
+		{name: "lower patch", v: piv.Version{Major: 4, Minor: 3, Patch: 0}, min: piv.Version{Major: 4, Minor: 3, Patch: 1}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, pivVersionLess(tt.v, tt.min))
+		})
+	}
+}
+
+func TestIsTeleportSlotCertificate(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	selfSignedCert, err := selfSignedTeleportClientCertificate(key, &key.PublicKey)
+	require.NoError(t, err)
+
+	teleportIssuedCert := &x509.Certificate{PublicKey: &key.PublicKey}
+	// foreignCert has nothing Teleport-specific about it at all — no matching org
+	// name, an issuer that isn't a Teleport CA — but it shares the slot's attested
+	// public key. isTeleportSlotCertificate accepts it anyway; see its doc comment
+	// for why that's a deliberate trade-off rather than an oversight.
+	foreignCert := &x509.Certificate{PublicKey: &key.PublicKey, Issuer: pkix.Name{Organization: []string{"some-other-tool"}}}
+	unknownCert := &x509.Certificate{PublicKey: &otherKey.PublicKey}
+	nonComparablePubKeyCert := &x509.Certificate{PublicKey: "not a public key"}
+
+	slotCert := &x509.Certificate{PublicKey: &key.PublicKey}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{name: "self signed marker certificate", cert: selfSignedCert, want: true},
+		{name: "teleport issued cert with matching slot public key", cert: teleportIssuedCert, want: true},
+		{name: "foreign cert with matching slot public key is accepted", cert: foreignCert, want: true},
+		{name: "cert with mismatched public key", cert: unknownCert, want: false},
+		{name: "cert with non-comparable public key", cert: nonComparablePubKeyCert, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, isTeleportSlotCertificate(tt.cert, slotCert))
+		})
+	}
+}
+
+func TestSelfSignedTeleportClientCertificateHasOrgName(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	cert, err := selfSignedTeleportClientCertificate(key, &key.PublicKey)
+	require.NoError(t, err)
+	require.Equal(t, []string{certOrgName}, cert.Subject.Organization)
+}